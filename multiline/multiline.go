@@ -1,12 +1,16 @@
 package multiline
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/grafana/loki/pkg/promtail/api"
 	"github.com/grafana/loki/pkg/util"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"hash/fnv"
 	"regexp"
 	"strings"
 	"sync"
@@ -22,8 +26,61 @@ const (
 	ErrMultiLineUnsupportedMode                = "unsupported mode"
 	ErrMultiLineUnvalidMaxWaitTime             = "invalid max_idle_duration duration"
 	ErrMultiLineModeRequireMaxWait             = "mode require max_idle_duration duration > 0 "
+	ErrCouldNotCompileMultiLineJSONStartRegex  = "could not compile json_start"
+	ErrMultiLineUnsupportedJSONFallback        = "unsupported json_fallback, must be \"emit\" or \"drop\""
+	ErrMultiLineHaltRequireFirstLineExpression = "halt_before/halt_with mode require first (the start pattern)"
+	ErrMultiLineUnsupportedTimestampStrategy   = "unsupported timestamp_strategy, must be \"first\", \"last\" or \"flush\""
 )
 
+// Sentinel errors callers can match against with errors.Is, so they can tell a rejected Config (fail
+// fast, nothing to retry) apart from a transient failure of the downstream handler (candidate for
+// requeue/retry/dead-letter) or a buffer that grew past its configured cap.
+var (
+	// ErrInvalidConfig is the cause of every error NewMultiLineParser returns for a Config that is
+	// missing a required field or combines options inconsistently.
+	ErrInvalidConfig = errors.New("invalid multiline configuration")
+
+	// ErrRegexCompile is the cause of every error NewMultiLineParser returns because one of the
+	// configured regular expressions failed to compile.
+	ErrRegexCompile = errors.New("could not compile multiline regular expression")
+
+	// ErrBufferOverflow is passed to Config.OnError when a buffered block grows past a configured cap
+	// (e.g. "json" mode's MaxBufferBytes) before it could be emitted cleanly.
+	ErrBufferOverflow = errors.New("multiline buffer overflow")
+
+	// ErrHandlerDownstream is the cause of every error emit() returns, wrapping whatever the `next`
+	// handler's Handle call returned, so callers can tell it apart from ErrInvalidConfig.
+	ErrHandlerDownstream = errors.New("downstream handler failed")
+)
+
+const (
+	// defaultJSONStartExpression is used to detect the start of a new record in "json" mode when
+	// Config.JSONStartExpression is empty
+	defaultJSONStartExpression = `^[{\[]`
+
+	jsonFallbackEmit = "emit"
+	jsonFallbackDrop = "drop"
+)
+
+// Config.TimestampStrategy values
+const (
+	timestampFirst = "first"
+	timestampLast  = "last"
+	timestampFlush = "flush"
+)
+
+// flush reasons, used as the `reason` label of the `promtail_multiline_flush_reason_total` metric
+const (
+	reasonMatch    = "match"
+	reasonIdle     = "idle"
+	reasonStop     = "stop"
+	reasonMaxLines = "maxlines"
+)
+
+// minFlusherInterval bounds how often the idle flusher ticks, regardless of `maxWait`, so a very small
+// (but non-zero) IdleDuration cannot spin the flusher goroutine in a busy loop.
+const minFlusherInterval = 100 * time.Millisecond
+
 // multilne EntryHandler is an api.EntryHandler that allows to flush buffered log lines and be stopped
 type EntryHandler interface {
 	//Flush orders the immediate drain of the log entries retained
@@ -32,6 +89,17 @@ type EntryHandler interface {
 	//Stop the service
 	Stop() error
 
+	// Chan returns the channel accepting api.Entry values for pipelines built around the channel-based
+	// api.EntryHandler contract (labels + logproto.Entry) instead of synchronous Handle calls. Entries
+	// pushed here are dispatched to the same mode state machine as Handle, from a dedicated goroutine
+	// started by NewMultiLineParser.
+	Chan() chan api.Entry
+
+	// Retained returns the number of log lines and bytes currently buffered across all streams and
+	// tracks, i.e. what would be flushed by a call to Flush. Intended for metrics/debug endpoints that
+	// want visibility into the parser's memory footprint beyond what the prometheus counters expose.
+	Retained() (lines int, bytes int)
+
 	api.EntryHandler
 }
 
@@ -42,6 +110,11 @@ type Config struct {
 	// * continue: a multiline entry continue with the next log line if the expression match
 	// * group: multiline entries are grouped by extracting a group key of each line
 	// * unordered_group: like group mode but supporting mixed lines with different group keys
+	// * halt_before: a multiline entry starts on a line matching FirstLineExpression and is emitted as
+	//   soon as a later line matches Expression, the halt condition, which does not belong to the entry
+	// * halt_with: like halt_before, but the line matching the halt condition is appended to the entry
+	//   before it is emitted
+	// * json: lines are buffered until the accumulated text parses as a complete JSON value
 	Mode string `yaml:"mode"`
 
 	// Expression is the main regular expression used for the selected mode of parsing
@@ -66,11 +139,75 @@ type Config struct {
 	// Separator text is added between lines of the multiline entry, e.g. you can use `delimiter: '\n'` to preserve
 	// line breaks on the entry. The default delimiter is empty.
 	Separator string `yaml:"separator"`
+
+	// ChannelBufferSize is the capacity of the channel returned by `Chan()`. A bounded channel lets the
+	// parser apply backpressure to producers instead of either blocking their goroutine on `Handle` or
+	// growing without limit. Defaults to 100.
+	ChannelBufferSize int `yaml:"channel_buffer_size"`
+
+	// JSONStartExpression is only used by the "json" mode. It is a regular expression used to recognise the
+	// line that may start a new JSON record, so a line arriving while no record is buffered and that does not
+	// look like the start of one can be passed downstream untouched instead of being absorbed forever.
+	// Defaults to `^[{\[]`.
+	JSONStartExpression string `yaml:"json_start"`
+
+	// MaxBufferBytes caps the number of bytes retained by the "json" mode while waiting for the buffered
+	// lines to become valid JSON. Once exceeded, FallbackAction is applied to the buffer. A zero value (the
+	// default) disables the cap, relying on IdleDuration to eventually flush malformed input.
+	MaxBufferBytes int `yaml:"max_buffer_bytes"`
+
+	// FallbackAction controls what happens to a "json" mode buffer that never becomes valid JSON, either
+	// because MaxBufferBytes was exceeded or because IdleDuration fired first. Possible values are "emit"
+	// (send the buffer as-is, the default) and "drop" (discard it).
+	FallbackAction string `yaml:"json_fallback"`
+
+	// MaxStreams caps the number of distinct LabelSets (streams) tracked at once, each with its own
+	// independent state machine and idle timer, so interleaved lines from unrelated streams (e.g. two
+	// tailed files, or several docker containers sharing a job label) are never glued together. When the
+	// cap is reached the least recently used stream is force-flushed and evicted to make room. A zero
+	// value (the default) disables the cap.
+	MaxStreams int `yaml:"max_streams"`
+
+	// PartitionBy selects which label names a stream is fingerprinted on, instead of the full LabelSet.
+	// Useful when labels other than the ones that actually distinguish independent log sources (e.g.
+	// `__filename__`) vary between lines of the very same stream, which would otherwise split it into
+	// several streams that never get to merge. An empty value (the default) fingerprints on the full
+	// LabelSet.
+	PartitionBy []string `yaml:"partition_by"`
+
+	// OnError, when set, is called with ErrHandlerDownstream (wrapping whatever the `next` handler
+	// returned) or ErrBufferOverflow (when a buffer is emitted/dropped for exceeding a configured cap),
+	// letting pipeline stages retry, drop, or dead-letter the block instead of only seeing it vanish
+	// into the idle flusher's debug log. Not settable from YAML: construct the Config in code to use it.
+	OnError func(err error) `yaml:"-"`
+
+	// MaxLines caps the number of log lines a single multiline entry may accumulate. Once reached, the
+	// entry is flushed immediately and a new one started, protecting memory against a malformed stack
+	// trace or a `continue` mode terminator that never arrives. A zero value (the default) disables the
+	// cap, relying on IdleDuration alone.
+	MaxLines int `yaml:"max_lines"`
+
+	// MaxBytes caps the size in bytes of a single multiline entry, with the same immediate-flush
+	// behaviour as MaxLines. A zero value (the default) disables the cap.
+	MaxBytes int `yaml:"max_bytes"`
+
+	// TruncationSuffix, when not empty, is appended to an entry flushed because it hit MaxLines or
+	// MaxBytes. It may contain one `%d` verb, which is substituted with the entry's line count (e.g.
+	// `"...[truncated %d lines]"`).
+	TruncationSuffix string `yaml:"truncation_suffix"`
+
+	// TimestampStrategy selects which timestamp is sent to the next handler when an entry is emitted.
+	// Possible values are:
+	// * first: the timestamp of the entry's first log line (the default)
+	// * last: the timestamp of the entry's last log line
+	// * flush: the wall-clock time the entry was flushed
+	TimestampStrategy string `yaml:"timestamp_strategy"`
 }
 
 type multiLineParser struct {
-	// modeHandler with specific parsing instructions. There is a handler for each parsing `Config Mode`.
-	modeHandler func(c *multiLineParser, labels model.LabelSet, t time.Time, entry string) error
+	// modeHandler with specific parsing instructions. There is a handler for each parsing `Config Mode`. It
+	// operates on the `streamState` of the stream the entry belongs to, not on the parser directly.
+	modeHandler func(c *multiLineParser, s *streamState, labels model.LabelSet, t time.Time, entry string) error
 
 	// compiled regexp for `Config Expression`
 	expressionRegex *regexp.Regexp
@@ -88,12 +225,225 @@ type multiLineParser struct {
 	// i.e. `Config Separator`
 	separator string
 
+	// compiled regexp for `Config JSONStartExpression`, only used by the "json" mode
+	jsonStartRegex *regexp.Regexp
+
+	// isJSONMode is true when the parser runs in "json" mode, so `flush` can apply `fallbackAction` to
+	// buffers that timed out without ever becoming valid JSON
+	isJSONMode bool
+
+	// i.e. `Config MaxBufferBytes`, only used by the "json" mode
+	maxBufferBytes int
+
+	// i.e. `Config FallbackAction`, only used by the "json" mode. Defaults to `jsonFallbackEmit`
+	fallbackAction string
+
 	// log with context multiline keyvals
 	logger log.Logger
 
 	// multitrack determines if the parser can manage multiple multiline entries at the same time
 	multitrack bool
 
+	// streams holds one `streamState` per distinct LabelSet fingerprint seen so far, so interleaved lines
+	// from unrelated streams (different tailed files, docker containers, ...) never share a block
+	streams map[uint64]*streamState
+
+	// maxStreams caps `len(streams)`, i.e. `Config MaxStreams`. Zero means unbounded
+	maxStreams int
+
+	// partitionBy is `Config PartitionBy`. When empty, streams are fingerprinted on the full LabelSet
+	partitionBy []string
+
+	// flusher ticker check that tracked multiline log entries not exceeded the max time they can be retained as
+	// specified by `maxWait`. Interval is half `maxWait`, clamped to a sane minimum.
+	flusher *time.Ticker
+
+	// flusherDone is closed by `Stop()` to terminate the flusher goroutine
+	flusherDone chan struct{}
+
+	// next os the entry handler use to handle the parsed multiline log entries
+	next api.EntryHandler
+
+	// entryChan is returned by `Chan()` for pipelines pushing api.Entry values directly. `chanConsumer`
+	// reads from it and dispatches to `Handle`. `Stop()` closes it to terminate `chanConsumer`, rather
+	// than signalling through a separate done channel, so every entry already queued is drained and
+	// dispatched before the goroutine exits instead of racing a shutdown signal against it
+	entryChan chan api.Entry
+
+	// chanConsumerDone is closed by `chanConsumer` once `entryChan` is closed and fully drained, so
+	// `Stop()` can block until every entry pushed through `Chan()` has reached `Handle` before it runs the
+	// final flush
+	chanConsumerDone chan struct{}
+
+	// stopOnce makes `Stop()` idempotent, guarding `flusherDone`/`entryChan` against a double close
+	stopOnce sync.Once
+
+	// mode is `Config Mode`, used as the `mode` label of the block/line counters
+	mode string
+
+	// metrics holds the parser's prometheus instrumentation
+	metrics *metrics
+
+	// i.e. `Config OnError`
+	onError func(err error)
+
+	// i.e. `Config MaxLines`. Zero means unbounded
+	maxLines int
+
+	// i.e. `Config MaxBytes`. Zero means unbounded
+	maxBytes int
+
+	// i.e. `Config TruncationSuffix`
+	truncationSuffix string
+
+	// haltIncludeLine is true for the "halt_with" mode and false for "halt_before", controlling whether
+	// the line matching the halt condition is appended to the entry it closes
+	haltIncludeLine bool
+
+	// timestampStrategy is `Config TimestampStrategy`, defaulting to timestampFirst
+	timestampStrategy string
+
+	// concurrency control for `streams` (and each stream's `multilines`/`multiline`) and handling entries
+	sync.Mutex
+}
+
+// metrics groups the prometheus instrumentation registered by `NewMultiLineParser`, so operators can
+// alert on runaway buffers, tune `IdleDuration`, and verify their regexes actually match in production.
+// Names follow promtail's own pipeline stage instrumentation convention (`promtail_<stage>_...`).
+type metrics struct {
+	blocksEmitted *prometheus.CounterVec
+	linesMerged   *prometheus.CounterVec
+	flushReason   *prometheus.CounterVec
+	activeTracks  *prometheus.GaugeVec
+	blockBytes    prometheus.Histogram
+	regexNoMatch  prometheus.Counter
+	truncations   prometheus.Counter
+}
+
+// newMetrics builds the multiline parser's metrics and, if `reg` is non-nil, registers them with it. `reg`
+// may be the same Registerer across more than one call (e.g. a config reload building a new parser without
+// unregistering the old one's metrics): registration reuses the already-registered collector instead of
+// panicking, so the metrics end up shared and cumulative across the parsers that feed them rather than
+// duplicated.
+func newMetrics(reg prometheus.Registerer) *metrics {
+	return &metrics{
+		blocksEmitted: registerCounterVec(reg, prometheus.CounterOpts{
+			Name: "promtail_multiline_blocks_emitted_total",
+			Help: "Total number of merged multiline blocks emitted downstream.",
+		}, []string{"mode"}),
+		linesMerged: registerCounterVec(reg, prometheus.CounterOpts{
+			Name: "promtail_multiline_lines_merged_total",
+			Help: "Total number of log lines merged into multiline blocks.",
+		}, []string{"mode"}),
+		flushReason: registerCounterVec(reg, prometheus.CounterOpts{
+			Name: "promtail_multiline_flush_reason_total",
+			Help: "Total number of blocks emitted downstream, by the reason they were flushed.",
+		}, []string{"reason"}),
+		activeTracks: registerGaugeVec(reg, prometheus.GaugeOpts{
+			Name: "promtail_multiline_active_tracks",
+			Help: "Number of multiline tracks currently buffered, by mode (group/unordered_group modes track more than one at a time).",
+		}, []string{"mode"}),
+		blockBytes: registerHistogram(reg, prometheus.HistogramOpts{
+			Name:    "promtail_multiline_block_bytes",
+			Help:    "Size in bytes of multiline blocks at the time they are emitted downstream.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+		}),
+		regexNoMatch: registerCounter(reg, prometheus.CounterOpts{
+			Name: "promtail_multiline_regex_no_match_total",
+			Help: "Total number of log lines that did not match the configured regular expression when one was expected to.",
+		}),
+		truncations: registerCounter(reg, prometheus.CounterOpts{
+			Name: "promtail_multiline_truncations_total",
+			Help: "Total number of blocks flushed early because they hit MaxLines or MaxBytes.",
+		}),
+	}
+}
+
+// registerCounterVec registers c with reg, reusing the already-registered collector instead of panicking
+// when `reg` already has a collector under the same fully-qualified name. A nil `reg` creates the collector
+// without registering it, same as `promauto.With(nil)`.
+func registerCounterVec(reg prometheus.Registerer, opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(opts, labels)
+	if reg == nil {
+		return c
+	}
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.CounterVec)
+		}
+		panic(err)
+	}
+	return c
+}
+
+// registerGaugeVec is registerCounterVec's counterpart for GaugeVec collectors.
+func registerGaugeVec(reg prometheus.Registerer, opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(opts, labels)
+	if reg == nil {
+		return g
+	}
+	if err := reg.Register(g); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(*prometheus.GaugeVec)
+		}
+		panic(err)
+	}
+	return g
+}
+
+// registerHistogram is registerCounterVec's counterpart for Histogram collectors.
+func registerHistogram(reg prometheus.Registerer, opts prometheus.HistogramOpts) prometheus.Histogram {
+	h := prometheus.NewHistogram(opts)
+	if reg == nil {
+		return h
+	}
+	if err := reg.Register(h); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(prometheus.Histogram)
+		}
+		panic(err)
+	}
+	return h
+}
+
+// registerCounter is registerCounterVec's counterpart for single Counter collectors.
+func registerCounter(reg prometheus.Registerer, opts prometheus.CounterOpts) prometheus.Counter {
+	c := prometheus.NewCounter(opts)
+	if reg == nil {
+		return c
+	}
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(prometheus.Counter)
+		}
+		panic(err)
+	}
+	return c
+}
+
+// chanConsumer reads api.Entry values pushed to `entryChan` and dispatches them to `Handle`, so the
+// parser can be used as a drop-in stage in pipelines built around the channel-based handler contract.
+// Ranging over the channel, rather than selecting against a separate done signal, guarantees every entry
+// queued before `Stop()` closes `entryChan` is dispatched before this goroutine exits: `chanConsumerDone`
+// is only closed once the range loop ends, i.e. once the channel is both closed and drained.
+func (c *multiLineParser) chanConsumer() {
+	defer close(c.chanConsumerDone)
+	for e := range c.entryChan {
+		if err := c.Handle(e.Labels, e.Timestamp, e.Line); err != nil {
+			level.Debug(c.logger).Log("msg", "failed to handle channel entry", "err", err)
+		}
+	}
+}
+
+// Chan returns the channel accepting api.Entry values, see `EntryHandler.Chan`
+func (c *multiLineParser) Chan() chan api.Entry {
+	return c.entryChan
+}
+
+// streamState holds the multiline tracking state for a single stream (one distinct LabelSet). Keeping
+// the state of each stream independent is what prevents lines from unrelated streams, which may arrive
+// interleaved, from being glued into the same block.
+type streamState struct {
 	// multilines is used when `multitrack=true`
 	// using a slice instead of a map to preserve the order of the log lines
 	// assumed there are only a few group keys for the same time window
@@ -101,18 +451,60 @@ type multiLineParser struct {
 	// up to ~100 entries it should not be problem to fetch
 	multilines []*multilineEntry
 
-	// multilines is used when `multitrack=false`
+	// multiline is used when `multitrack=false`
 	multiline *multilineEntry
 
-	// flusher ticker check that tracked multiline log entries not exceeded the max time they can be retained as
-	// specified by `maxWait`. Interval is half `maxWait`.
-	flusher *time.Ticker
+	// lastAccess is updated on every `Handle` call routed to this stream. Used to pick the least recently
+	// used stream for eviction when `maxStreams` is reached
+	lastAccess time.Time
+}
 
-	// next os the entry handler use to handle the parsed multiline log entries
-	next api.EntryHandler
+// newStreamState builds a streamState ready to receive its first entry
+func newStreamState(multitrack bool) *streamState {
+	s := &streamState{lastAccess: time.Now()}
+	if multitrack {
+		s.multilines = make([]*multilineEntry, 0, 7)
+	} else {
+		s.multiline = newMultiLineEntry("")
+	}
+	return s
+}
 
-	// concurrency control for `multilines`, `multiline` and handling entries
-	sync.Mutex
+// fetchLine returns the multiline entry for the specified `key` within this stream
+// a new entry is created if there is no such entry
+// so this function never returns nil
+func (s *streamState) fetchLine(key string) *multilineEntry {
+	for _, t := range s.multilines {
+		if t.key == key {
+			return t
+		}
+	}
+	ml := newMultiLineEntry(key)
+	s.multilines = append(s.multilines, ml)
+	return ml
+}
+
+// fingerprint computes a stable hash of a LabelSet used to key `multiLineParser.streams`
+func fingerprint(labels model.LabelSet) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(labels.String()))
+	return h.Sum64()
+}
+
+// selectLabels returns the subset of `labels` named in `names`, or `labels` unchanged if `names` is
+// empty. Used to fingerprint streams on a configurable label subset (`Config.PartitionBy`) instead of
+// the full LabelSet.
+func selectLabels(labels model.LabelSet, names []string) model.LabelSet {
+	if len(names) == 0 {
+		return labels
+	}
+	sub := make(model.LabelSet, len(names))
+	for _, n := range names {
+		if v, ok := labels[model.LabelName(n)]; ok {
+			sub[model.LabelName(n)] = v
+		}
+	}
+	return sub
 }
 
 // multilineEntry manages a multiline log entry
@@ -121,9 +513,13 @@ type multilineEntry struct {
 	enrollTime time.Time
 	// entry labels, updated for each log line added
 	labels model.LabelSet
-	// timestamp of the *first* log line entry. so, the timestamp send to the `next` handler  will  be the timestamp of
-	// the first log line
+	// timestamp of the *first* log line entry. Which of timestamp, lastTimestamp or the flush wall-clock
+	// time is sent to the `next` handler is selected by `multiLineParser.emitTimestamp`, per `Config
+	// TimestampStrategy`
 	timestamp time.Time
+	// lastTimestamp is the timestamp of the *last* log line appended so far, used when `Config
+	// TimestampStrategy` is "last"
+	lastTimestamp time.Time
 	// this multine log entry group key
 	key string
 	// text of the log lines concatenated
@@ -142,97 +538,267 @@ func (d *multilineEntry) reset() {
 func (d *multilineEntry) init(labels model.LabelSet, t time.Time, entry string) {
 	d.labels = labels.Clone()
 	d.timestamp = t
+	d.lastTimestamp = t
 	d.entry = entry
 	d.lines = 1
 	d.enrollTime = time.Now()
 }
 
 // append a line to the multi log line entry and merge the labels
-func (d *multilineEntry) append(labels model.LabelSet, entry string, delimiter string) {
+func (d *multilineEntry) append(labels model.LabelSet, t time.Time, entry string, delimiter string) {
 	d.labels = labels.Merge(labels)
 	d.entry = join(d.entry, delimiter, entry)
+	d.lastTimestamp = t
 	d.lines++
 }
 
 func (c *multiLineParser) startFlusher() {
-	// set the ticker interval to half the maxWait period to guarantee maxWait period for the entries
-	flusher := time.NewTicker(c.maxWait / 2)
+	// set the ticker interval to half the maxWait period to guarantee maxWait period for the entries,
+	// clamped to minFlusherInterval so a very small maxWait cannot spin the goroutine in a busy loop
+	interval := c.maxWait / 2
+	if interval < minFlusherInterval {
+		interval = minFlusherInterval
+	}
+	flusher := time.NewTicker(interval)
+	c.flusherDone = make(chan struct{})
+	done := c.flusherDone
 	go func() {
 		for {
 			select {
 			case <-flusher.C:
-				err := c.flush(false)
+				err := c.flush(false, reasonIdle)
 				if err != nil {
 					level.Debug(c.logger).Log("msg", "failed to flush multiline logs", "err", err)
 				}
+			case <-done:
+				return
 			}
 		}
 	}()
 	c.flusher = flusher
 }
 
+// emitTimestamp selects the timestamp sent to the `next` handler for `ml`, per `timestampStrategy`
+func (c *multiLineParser) emitTimestamp(ml *multilineEntry) time.Time {
+	switch c.timestampStrategy {
+	case timestampLast:
+		return ml.lastTimestamp
+	case timestampFlush:
+		return time.Now()
+	default:
+		return ml.timestamp
+	}
+}
+
+// emit sends a merged block downstream and records its observability metrics. A failure returned by the
+// `next` handler is wrapped as ErrHandlerDownstream and, if Config.OnError was set, also reported to it.
+func (c *multiLineParser) emit(ml *multilineEntry, reason string) error {
+	c.metrics.blocksEmitted.WithLabelValues(c.mode).Inc()
+	c.metrics.linesMerged.WithLabelValues(c.mode).Add(float64(ml.lines))
+	c.metrics.flushReason.WithLabelValues(reason).Inc()
+	c.metrics.blockBytes.Observe(float64(len(ml.entry)))
+
+	if err := c.next.Handle(ml.labels, c.emitTimestamp(ml), ml.entry); err != nil {
+		wrapped := errors.Wrap(ErrHandlerDownstream, err.Error())
+		c.reportError(wrapped)
+		return wrapped
+	}
+	return nil
+}
+
+// reportError invokes Config.OnError, if set
+func (c *multiLineParser) reportError(err error) {
+	if c.onError != nil {
+		c.onError(err)
+	}
+}
+
+// checkCap flushes and resets `ml` immediately, appending `truncationSuffix` and incrementing the
+// truncation counter, once it has reached `maxLines` lines or `maxBytes` bytes. This bounds the memory a single
+// multiline entry can consume regardless of how long a malformed block keeps matching the continuation
+// rule, e.g. a stuck `continue` mode terminator or a `group`/`unordered_group` key an attacker controls.
+// Returns whether `ml` was flushed.
+func (c *multiLineParser) checkCap(ml *multilineEntry) (bool, error) {
+	if (c.maxLines <= 0 || ml.lines < c.maxLines) && (c.maxBytes <= 0 || len(ml.entry) < c.maxBytes) {
+		return false, nil
+	}
+	if c.truncationSuffix != "" {
+		suffix := c.truncationSuffix
+		if strings.Contains(suffix, "%d") {
+			suffix = fmt.Sprintf(suffix, ml.lines)
+		}
+		ml.entry += suffix
+	}
+	c.metrics.truncations.Inc()
+	c.reportError(errors.Wrap(ErrBufferOverflow, "multiline block exceeded max_lines or max_bytes"))
+	err := c.emit(ml, reasonMaxLines)
+	ml.reset()
+	return true, err
+}
+
 // Flush force continuation to the handler of the retained multiline log entries
 func (c *multiLineParser) Flush() error {
-	return c.flush(true)
+	return c.flush(true, reasonIdle)
 }
 
-// Close the handler. Flush pending entries
-func (c *multiLineParser) Stop() error {
-	if c.flusher != nil {
-		// stop the ticker
-		c.flusher.Stop()
+// Retained returns the number of log lines and bytes currently buffered across all streams and tracks,
+// see EntryHandler.Retained
+func (c *multiLineParser) Retained() (lines int, bytes int) {
+	c.Lock()
+	for _, s := range c.streams {
+		if c.multitrack {
+			for _, t := range s.multilines {
+				lines += t.lines
+				bytes += len(t.entry)
+			}
+		} else {
+			lines += s.multiline.lines
+			bytes += len(s.multiline.entry)
+		}
 	}
-	// flush multiline entries
-	c.flush(true)
-	return nil
+	c.Unlock()
+	return
+}
+
+// Close the handler. Flush pending entries. Safe to call more than once; only the first call stops the
+// goroutines and flushes, later calls are a no-op returning nil.
+func (c *multiLineParser) Stop() error {
+	var err error
+	c.stopOnce.Do(func() {
+		if c.flusher != nil {
+			// stop the ticker and the flusher goroutine
+			c.flusher.Stop()
+			close(c.flusherDone)
+		}
+		// close entryChan so chanConsumer's range loop drains whatever is still queued and then exits,
+		// and wait for that drain to finish before flushing, so entries pushed through Chan() right before
+		// Stop() are dispatched to Handle (and so tracked in the streams flush below) instead of lost to a
+		// race between the channel still having data and a separate shutdown signal
+		close(c.entryChan)
+		<-c.chanConsumerDone
+		// flush multiline entries
+		err = c.flush(true, reasonStop)
+	})
+	return err
 }
 
 // check all current multiline entries for time out (maxWait reached)
 // if force is set handle all entries even if not time out occurred
-func (c *multiLineParser) flush(force bool) error {
+func (c *multiLineParser) flush(force bool, reason string) error {
 	now := time.Now()
 
 	c.Lock()
+	var err util.MultiError
+	active := 0
+	for fp, s := range c.streams {
+		err.Add(c.flushStream(s, now, force, reason))
+		if c.multitrack {
+			if n := len(s.multilines); n > 0 {
+				active += n
+			} else {
+				// nothing left buffered for this stream, drop its bucket
+				delete(c.streams, fp)
+			}
+		} else if s.multiline.lines > 0 {
+			active++
+		} else {
+			delete(c.streams, fp)
+		}
+	}
+	c.metrics.activeTracks.WithLabelValues(c.mode).Set(float64(active))
+	c.Unlock()
+
+	return err.Err()
+}
+
+// flushStream applies the timeout check (or forces it) to a single stream's retained entries. Callers
+// must hold `c.Mutex`.
+func (c *multiLineParser) flushStream(s *streamState, now time.Time, force bool, reason string) error {
 	var err util.MultiError
 	if c.multitrack {
 		// a new list is built with the valid entries
-		nextGen := make([]*multilineEntry, 0, len(c.multilines))
+		nextGen := make([]*multilineEntry, 0, len(s.multilines))
 		// check each multiline entry
-		for _, t := range c.multilines {
+		for _, t := range s.multilines {
 			// remove multilog entries with no lines
 			if t.lines == 0 {
 				continue
 			}
 			// handle entries if forced or it's out of validity range
 			if force || now.Sub(t.enrollTime) > c.maxWait {
-				err.Add(c.next.Handle(t.labels, t.timestamp, t.entry))
+				err.Add(c.emit(t, reason))
 			} else {
 				// append the entry to the next gen list if the entry is valid yet
 				nextGen = append(nextGen, t)
 			}
 		}
 		// assign the next gen list
-		c.multilines = nextGen
+		s.multilines = nextGen
 	} else {
-		t := c.multiline
+		t := s.multiline
 		if t.lines > 0 && (force || now.Sub(t.enrollTime) > c.maxWait) {
-			err.Add(c.next.Handle(t.labels, t.timestamp, t.entry))
-			// reuse struct
-			t.reset()
+			if c.isJSONMode && c.fallbackAction == jsonFallbackDrop && !json.Valid([]byte(t.entry)) {
+				// the buffer timed out without ever becoming valid JSON, drop it per FallbackAction
+				t.reset()
+			} else {
+				err.Add(c.emit(t, reason))
+				// reuse struct
+				t.reset()
+			}
 		}
 	}
-	c.Unlock()
-
 	return err.Err()
 }
 
+// fetchStream returns the streamState for the stream `labels` belongs to, creating one (evicting the
+// least recently used stream first if `maxStreams` is reached) if this is the first line seen for it.
+// Callers must hold `c.Mutex`.
+func (c *multiLineParser) fetchStream(labels model.LabelSet) *streamState {
+	fp := fingerprint(selectLabels(labels, c.partitionBy))
+	s, ok := c.streams[fp]
+	if !ok {
+		if c.maxStreams > 0 && len(c.streams) >= c.maxStreams {
+			c.evictLRUStream()
+		}
+		s = newStreamState(c.multitrack)
+		c.streams[fp] = s
+	}
+	s.lastAccess = time.Now()
+	return s
+}
+
+// evictLRUStream force-flushes and removes the least recently used stream to make room under
+// `maxStreams`. Callers must hold `c.Mutex`.
+func (c *multiLineParser) evictLRUStream() {
+	var lruFP uint64
+	var lruAccess time.Time
+	found := false
+	for fp, s := range c.streams {
+		if !found || s.lastAccess.Before(lruAccess) {
+			lruFP, lruAccess, found = fp, s.lastAccess, true
+		}
+	}
+	if !found {
+		return
+	}
+	_ = c.flushStream(c.streams[lruFP], time.Now(), true, reasonIdle)
+	delete(c.streams, lruFP)
+}
+
 // NewMultiLineParser construct a new multiline parser
-func NewMultiLineParser(logger log.Logger, config *Config, next api.EntryHandler) (EntryHandler, error) {
+func NewMultiLineParser(logger log.Logger, config *Config, next api.EntryHandler, reg prometheus.Registerer) (EntryHandler, error) {
 	if config == nil {
-		return nil, errors.New(ErrEmptyMultiLineConfig)
+		return nil, errors.Wrap(ErrInvalidConfig, ErrEmptyMultiLineConfig)
 	}
 	ml := &multiLineParser{}
 
+	// metrics config
+	ml.mode = config.Mode
+	ml.metrics = newMetrics(reg)
+
+	// error reporting config
+	ml.onError = config.OnError
+
 	// log config
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -244,18 +810,18 @@ func NewMultiLineParser(logger log.Logger, config *Config, next api.EntryHandler
 	if len(config.Expression) > 0 {
 		expr, err := regexp.Compile(config.Expression)
 		if err != nil {
-			return nil, errors.Wrap(err, ErrCouldNotCompileMultiLineExpressionRegex)
+			return nil, errors.Wrap(ErrRegexCompile, fmt.Sprintf("%s: %v", ErrCouldNotCompileMultiLineExpressionRegex, err))
 		}
 		ml.expressionRegex = expr
 	} else {
-		return nil, errors.New(ErrCouldMultiLineExpressionRequiredRegex)
+		return nil, errors.Wrap(ErrInvalidConfig, ErrCouldMultiLineExpressionRequiredRegex)
 	}
 
 	// first line expression config
 	if len(config.FirstLineExpression) > 0 {
 		expr, err := regexp.Compile(config.FirstLineExpression)
 		if err != nil {
-			return nil, errors.Wrap(err, ErrCouldNotCompileMultiLineFirstLineRegex)
+			return nil, errors.Wrap(ErrRegexCompile, fmt.Sprintf("%s: %v", ErrCouldNotCompileMultiLineFirstLineRegex, err))
 		}
 		ml.firstLineRegex = expr
 	}
@@ -264,7 +830,7 @@ func NewMultiLineParser(logger log.Logger, config *Config, next api.EntryHandler
 	if len(config.NextLineExpression) > 0 {
 		expr, err := regexp.Compile(config.NextLineExpression)
 		if err != nil {
-			return nil, errors.Wrap(err, ErrCouldNotCompileMultiLineNextLineRegex)
+			return nil, errors.Wrap(ErrRegexCompile, fmt.Sprintf("%s: %v", ErrCouldNotCompileMultiLineNextLineRegex, err))
 		}
 		ml.nextLineRegex = expr
 	}
@@ -275,7 +841,7 @@ func NewMultiLineParser(logger log.Logger, config *Config, next api.EntryHandler
 		var err error
 		ml.maxWait, err = time.ParseDuration(config.IdleDuration)
 		if err != nil {
-			return nil, errors.Wrap(err, ErrMultiLineUnvalidMaxWaitTime)
+			return nil, errors.Wrap(ErrInvalidConfig, fmt.Sprintf("%s: %v", ErrMultiLineUnvalidMaxWaitTime, err))
 		}
 	}
 
@@ -283,6 +849,23 @@ func NewMultiLineParser(logger log.Logger, config *Config, next api.EntryHandler
 
 	ml.separator = config.Separator
 
+	// line/byte cap config
+	ml.maxLines = config.MaxLines
+	ml.maxBytes = config.MaxBytes
+	ml.truncationSuffix = config.TruncationSuffix
+
+	// timestamp strategy config
+	switch config.TimestampStrategy {
+	case "", timestampFirst:
+		ml.timestampStrategy = timestampFirst
+	case timestampLast:
+		ml.timestampStrategy = timestampLast
+	case timestampFlush:
+		ml.timestampStrategy = timestampFlush
+	default:
+		return nil, errors.Wrap(ErrInvalidConfig, ErrMultiLineUnsupportedTimestampStrategy)
+	}
+
 	// mode and multitrack config
 	// and determine if maxWait is required
 	requireMaxWait := false
@@ -299,15 +882,44 @@ func NewMultiLineParser(logger log.Logger, config *Config, next api.EntryHandler
 		requireMaxWait = true
 	case "continue":
 		ml.modeHandler = handleContinueMode
+	case "halt_before", "halt_with":
+		if len(config.FirstLineExpression) == 0 {
+			return nil, errors.Wrap(ErrInvalidConfig, ErrMultiLineHaltRequireFirstLineExpression)
+		}
+		ml.modeHandler = handleHaltMode
+		ml.haltIncludeLine = config.Mode == "halt_with"
+	case "json":
+		ml.modeHandler = handleJSONMode
+		ml.isJSONMode = true
+		requireMaxWait = true
+
+		startExpr := config.JSONStartExpression
+		if startExpr == "" {
+			startExpr = defaultJSONStartExpression
+		}
+		expr, err := regexp.Compile(startExpr)
+		if err != nil {
+			return nil, errors.Wrap(ErrRegexCompile, fmt.Sprintf("%s: %v", ErrCouldNotCompileMultiLineJSONStartRegex, err))
+		}
+		ml.jsonStartRegex = expr
+
+		ml.maxBufferBytes = config.MaxBufferBytes
+
+		switch config.FallbackAction {
+		case "", jsonFallbackEmit:
+			ml.fallbackAction = jsonFallbackEmit
+		case jsonFallbackDrop:
+			ml.fallbackAction = jsonFallbackDrop
+		default:
+			return nil, errors.Wrap(ErrInvalidConfig, ErrMultiLineUnsupportedJSONFallback)
+		}
 	default:
-		return nil, errors.New(ErrMultiLineUnsupportedMode)
+		return nil, errors.Wrap(ErrInvalidConfig, ErrMultiLineUnsupportedMode)
 	}
 
-	if ml.multitrack {
-		ml.multilines = make([]*multilineEntry, 0, 7)
-	} else {
-		ml.multiline = newMultiLineEntry("")
-	}
+	ml.streams = make(map[uint64]*streamState)
+	ml.maxStreams = config.MaxStreams
+	ml.partitionBy = config.PartitionBy
 
 	// next handler config
 	if next == nil {
@@ -319,13 +931,22 @@ func NewMultiLineParser(logger log.Logger, config *Config, next api.EntryHandler
 
 	ml.next = next
 
+	// channel-based handler config
+	channelBufferSize := config.ChannelBufferSize
+	if channelBufferSize <= 0 {
+		channelBufferSize = 100
+	}
+	ml.entryChan = make(chan api.Entry, channelBufferSize)
+	ml.chanConsumerDone = make(chan struct{})
+	go ml.chanConsumer()
+
 	// post config
 
 	//start flusher if required
 	if ml.maxWait > 0 {
 		ml.startFlusher()
 	} else if requireMaxWait {
-		return nil, errors.New(ErrMultiLineModeRequireMaxWait)
+		return nil, errors.Wrap(ErrInvalidConfig, ErrMultiLineModeRequireMaxWait)
 	} else {
 		level.Warn(ml.logger).Log("msg", "multiline flusher disabled")
 	}
@@ -334,21 +955,23 @@ func NewMultiLineParser(logger log.Logger, config *Config, next api.EntryHandler
 }
 
 // Handler for newline mode. Lines are appended until a new line regular expression match
-func handleNewLineMode(c *multiLineParser, labels model.LabelSet, t time.Time, entry string) (err error) {
+func handleNewLineMode(c *multiLineParser, s *streamState, labels model.LabelSet, t time.Time, entry string) (err error) {
 	//continue mode handler is not multi tracked
-	ml := c.multiline
+	ml := s.multiline
 
 	if !c.expressionRegex.Match([]byte(entry)) {
 		// `entry` is not a new line
 		// if there is a next line regular expression use it to append the captured text  to the multiline entry
 		// if not append `entry` to the multiline entry
-		ml.append(labels, selection(c.nextLineRegex, entry), c.separator)
+		ml.append(labels, t, selection(c.nextLineRegex, entry), c.separator)
+		// flush immediately if the entry grew past MaxLines/MaxBytes instead of waiting for a new line
+		_, err = c.checkCap(ml)
 	} else {
 		// `entry` is a new line
 		// if a previous multiline entry exists (i.e. has lines) then handle it
 		if ml.lines > 0 {
 			//handle multiline entry content
-			err = c.next.Handle(ml.labels, ml.timestamp, ml.entry)
+			err = c.emit(ml, reasonMatch)
 		}
 		// init a new multiline entry
 		// overrides previous struct to reduce allocation
@@ -358,9 +981,9 @@ func handleNewLineMode(c *multiLineParser, labels model.LabelSet, t time.Time, e
 }
 
 // Handler for group mode. Lines are appended by the extracted group key of the lines
-func handleGroupMode(c *multiLineParser, labels model.LabelSet, t time.Time, entry string) (err error) {
+func handleGroupMode(c *multiLineParser, s *streamState, labels model.LabelSet, t time.Time, entry string) (err error) {
 	// group mode handler is not multi tracked
-	ml := c.multiline
+	ml := s.multiline
 	// the group key is the concatenation of the capturing groups of the regular expression
 	// `inv` is the inverse of `key`
 	key, inv := disjoint(c.expressionRegex, entry)
@@ -374,12 +997,14 @@ func handleGroupMode(c *multiLineParser, labels model.LabelSet, t time.Time, ent
 			line = selection(c.nextLineRegex, entry)
 		}
 		//append the line
-		ml.append(labels, line, c.separator)
+		ml.append(labels, t, line, c.separator)
+		// flush immediately if the entry grew past MaxLines/MaxBytes instead of waiting for the group key to change
+		_, err = c.checkCap(ml)
 	} else {
 		// the group key is not equal to the previous line
 		// handle the previous multiline entry if there is any
 		if ml.lines > 0 {
-			err = c.next.Handle(ml.labels, ml.timestamp, ml.entry)
+			err = c.emit(ml, reasonMatch)
 		}
 		// init the multiline entry with the log text or capturing groups if first line regular expression is defined
 		// overrides previous struct to reduce allocation
@@ -391,14 +1016,14 @@ func handleGroupMode(c *multiLineParser, labels model.LabelSet, t time.Time, ent
 }
 
 // Handler for unordered group mode. Lines are appended by the extracted group key of the lines tracking multiple keys
-func handleUnorderedGroupMode(c *multiLineParser, labels model.LabelSet, t time.Time, entry string) (err error) {
+func handleUnorderedGroupMode(c *multiLineParser, s *streamState, labels model.LabelSet, t time.Time, entry string) (err error) {
 	// the group key is the concatenation of the capturing groups of the regular expression
 	// `inv` is the inverse of `key`
 	key, inv := disjoint(c.expressionRegex, entry)
 	// unordered group mode handler is multi tracked
 	// fetch the multiline entry of the line group key
 	// note: if there is not a multiline entry for the key a new one is created
-	ml := c.fetchLine(key)
+	ml := s.fetchLine(key)
 	if ml.lines > 0 {
 		// there is previous log lines for the group key so append the new line
 		// the default line to appended is the line without the group key to avoid repetition
@@ -409,7 +1034,9 @@ func handleUnorderedGroupMode(c *multiLineParser, labels model.LabelSet, t time.
 			line = selection(c.nextLineRegex, entry)
 		}
 		// append the new line
-		ml.append(labels, line, c.separator)
+		ml.append(labels, t, line, c.separator)
+		// flush immediately if the entry grew past MaxLines/MaxBytes instead of waiting for the group key to rotate
+		_, err = c.checkCap(ml)
 	} else {
 		// init the multiline entry with the log text or capturing groups if first line regular expression is defined
 		ml.init(labels, t, selection(c.firstLineRegex, entry))
@@ -420,16 +1047,18 @@ func handleUnorderedGroupMode(c *multiLineParser, labels model.LabelSet, t time.
 }
 
 // Handler for continue mode. Lines are appended to the next if a continuation regular expression match the line
-func handleContinueMode(c *multiLineParser, labels model.LabelSet, t time.Time, entry string) (err error) {
+func handleContinueMode(c *multiLineParser, s *streamState, labels model.LabelSet, t time.Time, entry string) (err error) {
 	// group mode handler is not multi tracked
-	ml := c.multiline
+	ml := s.multiline
 	//select the capturing text for the expression regex
 	line := selection(c.expressionRegex, entry)
 	if line != "" {
 		// the line has a continuation mark
 		if ml.lines > 0 {
 			// there is a previous multiline entry so append text
-			ml.append(labels, selection(c.nextLineRegex, line), c.separator)
+			ml.append(labels, t, selection(c.nextLineRegex, line), c.separator)
+			// flush immediately if the entry grew past MaxLines/MaxBytes instead of waiting for the terminator
+			_, err = c.checkCap(ml)
 		} else {
 			// if there is not a previous multiline entry so init one
 			ml.init(labels, t, selection(c.firstLineRegex, line))
@@ -438,9 +1067,9 @@ func handleContinueMode(c *multiLineParser, labels model.LabelSet, t time.Time,
 		// the line has not a continuation mark
 		if ml.lines > 0 {
 			// there is a previous multiline entry so append the text
-			ml.append(labels, selection(c.nextLineRegex, entry), c.separator)
+			ml.append(labels, t, selection(c.nextLineRegex, entry), c.separator)
 			// and handle it
-			err = c.next.Handle(ml.labels, ml.timestamp, ml.entry)
+			err = c.emit(ml, reasonMatch)
 			// reset multiline entry
 			ml.reset()
 		} else {
@@ -452,6 +1081,88 @@ func handleContinueMode(c *multiLineParser, labels model.LabelSet, t time.Time,
 	return
 }
 
+// Handler for halt_before/halt_with mode. A multiline entry starts on a line matching FirstLineExpression
+// (the start pattern) and is emitted as soon as a later line matches Expression (the halt condition),
+// which closes the entry without belonging to it in "halt_before", or is appended to it before it is
+// emitted in "halt_with". This lets users bracket constructs like SQL statements ending in `;` or
+// transaction blocks closed by a known marker, which newline/continue cannot express.
+func handleHaltMode(c *multiLineParser, s *streamState, labels model.LabelSet, t time.Time, entry string) (err error) {
+	// halt mode handler is not multi tracked
+	ml := s.multiline
+
+	if ml.lines == 0 {
+		// no entry open yet, one only starts on a line matching the start pattern
+		if !c.firstLineRegex.MatchString(entry) {
+			return c.next.Handle(labels, t, entry)
+		}
+		ml.init(labels, t, entry)
+		return
+	}
+
+	if !c.expressionRegex.MatchString(entry) {
+		// the halt condition did not match, keep absorbing lines
+		ml.append(labels, t, entry, c.separator)
+		_, err = c.checkCap(ml)
+		return
+	}
+
+	// the halt condition matched, close the entry
+	if c.haltIncludeLine {
+		ml.append(labels, t, entry, c.separator)
+	}
+	err = c.emit(ml, reasonMatch)
+	ml.reset()
+
+	if !c.haltIncludeLine {
+		// the halting line does not belong to the closed entry, it may start the next one
+		if c.firstLineRegex.MatchString(entry) {
+			ml.init(labels, t, entry)
+		} else if err2 := c.next.Handle(labels, t, entry); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return
+}
+
+// Handler for json mode. Lines are buffered until the accumulated text parses as a complete JSON value,
+// which reassembles pretty-printed JSON log records (e.g. Java/Node apps that split an object across
+// several lines) that the regex based modes cannot reliably join.
+func handleJSONMode(c *multiLineParser, s *streamState, labels model.LabelSet, t time.Time, entry string) (err error) {
+	// json mode handler is not multi tracked
+	ml := s.multiline
+
+	if ml.lines == 0 && !c.jsonStartRegex.MatchString(entry) {
+		// nothing buffered yet and this line does not look like the start of a JSON record: hand it
+		// downstream untouched instead of silently absorbing it forever
+		c.metrics.regexNoMatch.Inc()
+		return c.next.Handle(labels, t, entry)
+	}
+
+	if ml.lines == 0 {
+		ml.init(labels, t, entry)
+	} else {
+		ml.append(labels, t, entry, c.separator)
+	}
+
+	if json.Valid([]byte(ml.entry)) {
+		err = c.emit(ml, reasonMatch)
+		ml.reset()
+		return
+	}
+
+	if c.maxBufferBytes > 0 && len(ml.entry) > c.maxBufferBytes {
+		c.reportError(errors.Wrap(ErrBufferOverflow, "json mode buffer exceeded max_buffer_bytes"))
+		if c.fallbackAction == jsonFallbackDrop {
+			ml.reset()
+			return
+		}
+		// the buffer exceeded the cap without ever becoming valid JSON, emit it as-is per FallbackAction
+		err = c.emit(ml, reasonIdle)
+		ml.reset()
+	}
+	return
+}
+
 // Multiline entry handler
 func (c *multiLineParser) Handle(labels model.LabelSet, t time.Time, entry string) (err error) {
 	// labels should not be nil, never
@@ -459,26 +1170,13 @@ func (c *multiLineParser) Handle(labels model.LabelSet, t time.Time, entry strin
 		labels = model.LabelSet{}
 	}
 	c.Lock()
-	// use mode handler to handle the entry
-	err = c.modeHandler(c, labels, t, entry)
+	// route to this stream's state and use mode handler to handle the entry
+	s := c.fetchStream(labels)
+	err = c.modeHandler(c, s, labels, t, entry)
 	c.Unlock()
 	return
 }
 
-// fetchLine returns the multiline entry for the spcified `key`
-// a new entry is created if there is no such entry
-// so this function never returns nil
-func (c *multiLineParser) fetchLine(key string) *multilineEntry {
-	for _, t := range c.multilines {
-		if t.key == key {
-			return t
-		}
-	}
-	ml := newMultiLineEntry(key)
-	c.multilines = append(c.multilines, ml)
-	return ml
-}
-
 // make a new multiline entry properly initialized
 func newMultiLineEntry(key string) *multilineEntry {
 	return &multilineEntry{labels: model.LabelSet{}, key: key}
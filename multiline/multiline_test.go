@@ -1,12 +1,16 @@
 package multiline
 
 import (
+	"errors"
 	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/cortexproject/cortex/pkg/util"
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/promtail/api"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/assert"
 )
@@ -221,6 +225,176 @@ func TestMultilineModes(t *testing.T) {
 			},
 			"",
 		},
+
+		"json mode merges a record split across lines": {
+			Config{
+				Mode: "json",
+			},
+			[]string{
+				`{`,
+				`"a":1,`,
+				`"b":2}`,
+			},
+			[]string{
+				`{"a":1,"b":2}`,
+			},
+			"",
+		},
+
+		"json mode passes through lines that do not look like a record start": {
+			Config{
+				Mode: "json",
+			},
+			[]string{
+				"not a json line",
+				`{"a":1}`,
+			},
+			[]string{
+				"not a json line",
+				`{"a":1}`,
+			},
+			"",
+		},
+
+		"json mode custom start expression": {
+			Config{
+				Mode:                "json",
+				JSONStartExpression: `^@`,
+			},
+			[]string{
+				`@{"a":1}`,
+			},
+			[]string{
+				// `@{"a":1}` never becomes valid JSON, so it is only emitted once Stop forces a flush,
+				// applying the default "emit" FallbackAction
+				`@{"a":1}`,
+			},
+			"",
+		},
+
+		"json mode drops an incomplete buffer per json_fallback=drop": {
+			Config{
+				Mode:           "json",
+				FallbackAction: "drop",
+			},
+			[]string{
+				`{"a":1,`,
+			},
+			[]string{},
+			"",
+		},
+
+		"halt_before mode excludes the halting line from the entry": {
+			Config{
+				Mode:                "halt_before",
+				FirstLineExpression: `^BEGIN`,
+				Expression:          `^END`,
+				Separator:           "\n",
+			},
+			[]string{
+				"BEGIN tx",
+				"line 1",
+				"line 2",
+				"END",
+				"other",
+			},
+			[]string{
+				"BEGIN tx\nline 1\nline 2",
+				// the halting line does not belong to the entry it closes, and does not start a new one
+				// either, so it is forwarded downstream on its own, same as "other"
+				"END",
+				"other",
+			},
+			"",
+		},
+
+		"halt_with mode includes the halting line in the entry": {
+			Config{
+				Mode:                "halt_with",
+				FirstLineExpression: `^BEGIN`,
+				Expression:          `^END`,
+				Separator:           "\n",
+			},
+			[]string{
+				"BEGIN tx",
+				"line 1",
+				"END",
+			},
+			[]string{
+				"BEGIN tx\nline 1\nEND",
+			},
+			"",
+		},
+
+		"halt_before mode where a single line is both start and halt": {
+			Config{
+				Mode:                "halt_before",
+				FirstLineExpression: `^BEGIN`,
+				Expression:          `^BEGIN`,
+				Separator:           "\n",
+			},
+			[]string{
+				"BEGIN tx 1",
+				"line 1",
+				"BEGIN tx 2",
+				"line 2",
+			},
+			[]string{
+				"BEGIN tx 1\nline 1",
+				"BEGIN tx 2\nline 2",
+			},
+			"",
+		},
+
+		"max_lines flushes and truncates before the block grows further": {
+			Config{
+				Mode:             "newline",
+				Expression:       "^[^ ]",
+				MaxLines:         2,
+				TruncationSuffix: " [...]",
+			},
+			[]string{
+				"start",
+				" c1",
+				" c2",
+				" c3",
+			},
+			[]string{
+				"start c1 [...]",
+				" c2 c3 [...]",
+			},
+			"",
+		},
+
+		"max_bytes flushes and truncates before the block grows further": {
+			Config{
+				Mode:             "newline",
+				Expression:       "^[^ ]",
+				MaxBytes:         8,
+				TruncationSuffix: "!",
+			},
+			[]string{
+				"AAAA",
+				" BBBB",
+				" CCCC",
+			},
+			[]string{
+				"AAAA BBBB!",
+				// the final block is flushed by Stop(), not by checkCap, so it is not truncated
+				" CCCC",
+			},
+			"",
+		},
+
+		"halt mode requires first_expression": {
+			Config{
+				Mode:       "halt_before",
+				Expression: `^END`,
+			},
+			nil,
+			nil,
+			ErrMultiLineHaltRequireFirstLineExpression + ": " + ErrInvalidConfig.Error(),
+		},
 	}
 
 	for testName, testData := range tests {
@@ -231,7 +405,7 @@ func TestMultilineModes(t *testing.T) {
 			ch := collectHandler{}
 
 			testData.config.IdleDuration = "1000s"
-			pl, err := NewMultiLineParser(util.Logger, &testData.config, &ch)
+			pl, err := NewMultiLineParser(util.Logger, &testData.config, &ch, nil)
 			if err != nil {
 				if testData.err != err.Error() {
 					t.Fatal(err)
@@ -279,7 +453,7 @@ func TestMultilineTimeout(t *testing.T) {
 	}
 	ch := collectHandler{}
 
-	pl, err := NewMultiLineParser(util.Logger, &cfg, &ch)
+	pl, err := NewMultiLineParser(util.Logger, &cfg, &ch, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -315,7 +489,7 @@ func TestMultilineMultiTrackTimeout(t *testing.T) {
 	}
 	ch := collectHandler{}
 
-	pl, err := NewMultiLineParser(util.Logger, &cfg, &ch)
+	pl, err := NewMultiLineParser(util.Logger, &cfg, &ch, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -343,6 +517,283 @@ func TestMultilineMultiTrackTimeout(t *testing.T) {
 	}
 }
 
+func TestMultilineMetricsReuseRegistererAcrossParsers(t *testing.T) {
+	cfg := Config{
+		Mode:         "newline",
+		Expression:   "^[^ ]",
+		IdleDuration: "1000s",
+	}
+	reg := prometheus.NewRegistry()
+	ch := collectHandler{}
+
+	// a second parser built against the same Registerer (e.g. a config reload) must not panic on
+	// duplicate registration, and should share the first parser's collectors instead
+	pl1, err := NewMultiLineParser(util.Logger, &cfg, &ch, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl2, err := NewMultiLineParser(util.Logger, &cfg, &ch, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Same(t, pl1.(*multiLineParser).metrics.blocksEmitted, pl2.(*multiLineParser).metrics.blocksEmitted)
+
+	assert.NoError(t, pl1.Stop())
+	assert.NoError(t, pl2.Stop())
+}
+
+type timestampCollectHandler struct {
+	timestamps []time.Time
+}
+
+func (s *timestampCollectHandler) Handle(_ model.LabelSet, t time.Time, _ string) error {
+	s.timestamps = append(s.timestamps, t)
+	return nil
+}
+
+func TestMultilineTimestampStrategy(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		strategy string
+		want     func(first, last time.Time) time.Time
+	}{
+		"first (default)": {
+			"",
+			func(first, last time.Time) time.Time { return first },
+		},
+		"first (explicit)": {
+			"first",
+			func(first, last time.Time) time.Time { return first },
+		},
+		"last": {
+			"last",
+			func(first, last time.Time) time.Time { return last },
+		},
+	}
+
+	for testName, testData := range tests {
+		testData := testData
+		t.Run(testName, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := Config{
+				Mode:              "newline",
+				Expression:        "^[^ ]",
+				IdleDuration:      "1000s",
+				TimestampStrategy: testData.strategy,
+			}
+			ch := timestampCollectHandler{}
+			pl, err := NewMultiLineParser(util.Logger, &cfg, &ch, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ls := model.LabelSet{}
+			first := time.Now().Add(-time.Minute)
+			last := time.Now()
+
+			if err := pl.Handle(ls, first, "line 1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := pl.Handle(ls, last, " subline"); err != nil {
+				t.Fatal(err)
+			}
+			if err := pl.Stop(); err != nil {
+				t.Fatal(err)
+			}
+
+			if assert.Len(t, ch.timestamps, 1) {
+				assert.True(t, ch.timestamps[0].Equal(testData.want(first, last)))
+			}
+		})
+	}
+}
+
+func TestMultilineTimestampStrategyFlush(t *testing.T) {
+	cfg := Config{
+		Mode:              "newline",
+		Expression:        "^[^ ]",
+		IdleDuration:      "1000s",
+		TimestampStrategy: "flush",
+	}
+	ch := timestampCollectHandler{}
+	pl, err := NewMultiLineParser(util.Logger, &cfg, &ch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := model.LabelSet{}
+	lineTime := time.Now().Add(-time.Hour)
+	if err := pl.Handle(ls, lineTime, "line 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	if err := pl.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	if assert.Len(t, ch.timestamps, 1) {
+		assert.False(t, ch.timestamps[0].Before(before))
+		assert.False(t, ch.timestamps[0].After(after))
+	}
+}
+
+func TestMultilineUnsupportedTimestampStrategy(t *testing.T) {
+	cfg := Config{
+		Mode:              "newline",
+		Expression:        "^[^ ]",
+		TimestampStrategy: "bogus",
+	}
+	_, err := NewMultiLineParser(util.Logger, &cfg, nil, nil)
+	if assert.Error(t, err) {
+		assert.Equal(t, ErrMultiLineUnsupportedTimestampStrategy+": "+ErrInvalidConfig.Error(), err.Error())
+	}
+}
+
+func TestMultilineMaxLinesReportsBufferOverflowToOnError(t *testing.T) {
+	var reported []error
+	cfg := Config{
+		Mode:         "newline",
+		Expression:   "^[^ ]",
+		IdleDuration: "1000s",
+		MaxLines:     2,
+		OnError: func(err error) {
+			reported = append(reported, err)
+		},
+	}
+	ch := collectHandler{}
+
+	pl, err := NewMultiLineParser(util.Logger, &cfg, &ch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := model.LabelSet{}
+	ts := time.Now()
+	for _, s := range []string{"start", " c1"} {
+		if err := pl.Handle(ls, ts, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pl.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, reported, 1) {
+		assert.True(t, errors.Is(reported[0], ErrBufferOverflow))
+	}
+}
+
+func TestMultilinePartitionBy(t *testing.T) {
+	cfg := Config{
+		Mode:         "newline",
+		Expression:   "^[^ ]",
+		IdleDuration: "1000s",
+		PartitionBy:  []string{"job"},
+	}
+	ch := collectHandler{}
+
+	pl, err := NewMultiLineParser(util.Logger, &cfg, &ch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Now()
+	// same "job" label, but a varying "file" label that would split these into different streams without
+	// PartitionBy: they must still be tracked as a single stream and merged into one block
+	if err := pl.Handle(model.LabelSet{"job": "a", "file": "f1"}, ts, "start"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Handle(model.LabelSet{"job": "a", "file": "f2"}, ts, " cont"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Handle(model.LabelSet{"job": "a", "file": "f3"}, ts, "end"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, ch.lines, 2) {
+		assert.Equal(t, "start cont", ch.lines[0])
+		assert.Equal(t, "end", ch.lines[1])
+	}
+}
+
+func TestMultilineMaxStreamsEvictsLeastRecentlyUsed(t *testing.T) {
+	cfg := Config{
+		Mode:         "continue",
+		Expression:   `(.*)\\$`,
+		IdleDuration: "1000s",
+		MaxStreams:   2,
+	}
+	ch := collectHandler{}
+
+	pl, err := NewMultiLineParser(util.Logger, &cfg, &ch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Now()
+	// stream "1" is opened, then becomes the least recently used once "2" and "3" are touched
+	if err := pl.Handle(model.LabelSet{"stream": "1"}, ts, `event1\`); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.Handle(model.LabelSet{"stream": "2"}, ts, `event2\`); err != nil {
+		t.Fatal(err)
+	}
+	// a third distinct stream exceeds MaxStreams: stream "1", the least recently used, is force-flushed
+	// and evicted to make room
+	if err := pl.Handle(model.LabelSet{"stream": "3"}, ts, `event3\`); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, ch.lines, 1) {
+		assert.Equal(t, "event1", ch.lines[0])
+	}
+
+	if err := pl.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	// streams "2" and "3" were never evicted, and are flushed by Stop()
+	assert.Len(t, ch.lines, 3)
+}
+
+func TestMultilineChan(t *testing.T) {
+	cfg := Config{
+		Mode:         "newline",
+		Expression:   "^[^ ]",
+		IdleDuration: "1000s",
+	}
+	ch := collectHandler{}
+
+	pl, err := NewMultiLineParser(util.Logger, &cfg, &ch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Now()
+	ls := model.LabelSet{}
+	pl.Chan() <- api.Entry{Labels: ls, Entry: logproto.Entry{Timestamp: ts, Line: "line 1"}}
+	pl.Chan() <- api.Entry{Labels: ls, Entry: logproto.Entry{Timestamp: ts, Line: " subline"}}
+	pl.Chan() <- api.Entry{Labels: ls, Entry: logproto.Entry{Timestamp: ts, Line: "line 2"}}
+
+	// Stop() closes entryChan and waits for chanConsumer to drain it before flushing, so every entry
+	// pushed above is guaranteed to have reached Handle by the time it returns
+	if err := pl.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, ch.lines, 2) {
+		assert.Equal(t, "line 1 subline", ch.lines[0])
+		assert.Equal(t, "line 2", ch.lines[1])
+	}
+}
+
 func TestMultilineDisjoint(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,124 @@
+package multilinestage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/d4c7/promtail-sample-plugin/multiline"
+	"github.com/go-kit/kit/log"
+	"github.com/grafana/loki/pkg/logentry/stages"
+	"github.com/mitchellh/mapstructure"
+	"github.com/prometheus/common/model"
+)
+
+var descriptor = stages.PluginDescriptor{
+	Name:    "multiline",
+	Version: "0.0.1",
+	Stagger: NewStage,
+}
+
+func Descriptor() stages.PluginDescriptor {
+	return descriptor
+}
+
+func NewStage(stgCfg *stages.StageConfig) (stages.Stage, error) {
+	cfg := &multiline.Config{}
+	err := mapstructure.Decode(stgCfg.Config, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &multilineStage{
+		logger: stgCfg.Logger,
+	}
+
+	parser, err := multiline.NewMultiLineParser(stgCfg.Logger, cfg, ms, nil)
+	if err != nil {
+		return nil, err
+	}
+	ms.parser = parser
+
+	return ms, nil
+}
+
+// multilineStage wraps the `multiline` package as a `stages.Stage`. `Process` is synchronous and has no
+// way to submit an entry to the pipeline except by rewriting the `labels`/`t`/`entry` it was called with,
+// but multiline merges a block only once a later line (or the idle timer) closes it, so the merged block
+// rarely belongs to the same call that produced it. `Process` keeps a FIFO queue of merged blocks
+// (appended to by `Handle`, which the parser calls as its `next`, both synchronously from within `Process`
+// and asynchronously from the parser's background idle flusher) and, on each call, forwards the oldest
+// queued block in place of the current line if one is queued, clearing `labels` to signal the pipeline to
+// drop the current line otherwise (the same convention promtail's own `drop` stage uses, since
+// `stages.Stage` has no dedicated "drop this line" return value). A queue, rather than a single slot, is
+// required because the idle flusher can run concurrently with `Process`: a single slot written by both
+// would let the flusher's call clobber the block `Process`'s own `Handle` call just produced, silently
+// losing a block that did have a line to ride out on, instead of merely forwarding it late.
+//
+// This means a line can surface one or more `Process` calls after it was read. Worse, a block closed only
+// by the idle timer - with no later line of any stream ever passing through `Process` again, e.g. the
+// last stream going away for good right after its last traced line - is never forwarded at all: `stages.Stage`
+// only gives this adapter a hook that runs once per input line, so there is no way to push an entry
+// independent of one. Deployments that need idle-timeout flushes to always reach the sink should wire
+// `multiline.NewMultiLineParser` directly with a real `next api.EntryHandler` (consuming lines via
+// `Chan()`) instead of registering this package as a `stages.Stage` plugin; the parser's idle flusher calls
+// `next.Handle` directly in that setup, with no dependency on a subsequent line.
+type multilineStage struct {
+	logger log.Logger
+	parser multiline.EntryHandler
+
+	mu      sync.Mutex
+	pending []*mergedEntry
+}
+
+// mergedEntry is a block merged by the multiline parser, captured until the next `Process` call
+type mergedEntry struct {
+	labels model.LabelSet
+	time   time.Time
+	entry  string
+}
+
+// Handle implements api.EntryHandler. It's called by the multiline parser, synchronously from `Process`
+// or asynchronously from its idle flusher, whenever a block is merged
+func (m *multilineStage) Handle(labels model.LabelSet, t time.Time, entry string) error {
+	m.mu.Lock()
+	m.pending = append(m.pending, &mergedEntry{labels: labels, time: t, entry: entry})
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *multilineStage) Process(labels model.LabelSet, extracted map[string]interface{}, t *time.Time, entry *string) {
+	_ = m.parser.Handle(labels, *t, *entry)
+
+	m.mu.Lock()
+	var pending *mergedEntry
+	if len(m.pending) > 0 {
+		pending = m.pending[0]
+		m.pending = m.pending[1:]
+	}
+	m.mu.Unlock()
+
+	if pending == nil {
+		// the line was buffered inside the parser and did not close a block: drop it from the pipeline by
+		// clearing its labels, rather than forwarding it with an empty body. It may still surface merged
+		// into a later block on a subsequent call (or, if the block is only ever closed by the idle timer,
+		// not at all - see the doc comment on multilineStage)
+		for k := range labels {
+			delete(labels, k)
+		}
+		*entry = ""
+		return
+	}
+
+	for k := range labels {
+		delete(labels, k)
+	}
+	for k, v := range pending.labels {
+		labels[k] = v
+	}
+	*t = pending.time
+	*entry = pending.entry
+}
+
+func (m *multilineStage) Name() string {
+	return descriptor.Name
+}
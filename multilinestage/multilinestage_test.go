@@ -0,0 +1,135 @@
+package multilinestage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/util"
+	"github.com/d4c7/promtail-sample-plugin/multiline"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestStage builds a multilineStage wired to a real parser, the same way NewStage does, without going
+// through the stages.StageConfig/mapstructure decoding path.
+func newTestStage(t *testing.T, cfg *multiline.Config) *multilineStage {
+	t.Helper()
+	ms := &multilineStage{logger: util.Logger}
+	parser, err := multiline.NewMultiLineParser(util.Logger, cfg, ms, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.parser = parser
+	return ms
+}
+
+func TestMultilineStageForwardsMergedBlock(t *testing.T) {
+	ms := newTestStage(t, &multiline.Config{
+		Mode:         "newline",
+		Expression:   "^[^ ]",
+		IdleDuration: "1000s",
+	})
+
+	labels := model.LabelSet{"stream": "a"}
+	extracted := map[string]interface{}{}
+	ts := time.Now()
+
+	entry := "line 1"
+	ms.Process(labels, extracted, &ts, &entry)
+	assert.Empty(t, labels, "first line of a block is buffered, not forwarded")
+
+	// Process cleared labels above; the next line of the same stream arrives with its own labels
+	labels = model.LabelSet{"stream": "a"}
+	entry = " subline 1.1"
+	ms.Process(labels, extracted, &ts, &entry)
+	assert.Empty(t, labels)
+
+	// a new line matching the start expression closes the previous block, which surfaces on this call
+	labels = model.LabelSet{"stream": "a"}
+	entry = "line 2"
+	ms.Process(labels, extracted, &ts, &entry)
+	assert.Equal(t, "line 1 subline 1.1", entry)
+	assert.Equal(t, model.LabelSet{"stream": "a"}, labels)
+}
+
+func TestMultilineStageDropsLinesWithoutPendingBlock(t *testing.T) {
+	ms := newTestStage(t, &multiline.Config{
+		Mode:         "newline",
+		Expression:   "^[^ ]",
+		IdleDuration: "1000s",
+	})
+
+	labels := model.LabelSet{"stream": "a"}
+	extracted := map[string]interface{}{}
+	ts := time.Now()
+	entry := " continuation, no block closed yet"
+
+	ms.Process(labels, extracted, &ts, &entry)
+
+	assert.Empty(t, entry, "the line must not be forwarded with an empty body")
+	assert.Empty(t, labels, "labels must be cleared so the pipeline drops the line entirely")
+}
+
+// TestMultilineStageQueuesMultiplePendingBlocks pins the fix for the race between Process's own synchronous
+// Handle call and the parser's background idle flusher: if both merge a block before Process gets around to
+// reading m.pending, a single-slot m.pending would let the second Handle call silently clobber the first.
+// Queuing instead means both blocks are retained and forwarded, oldest first, one per subsequent Process call.
+func TestMultilineStageQueuesMultiplePendingBlocks(t *testing.T) {
+	ms := newTestStage(t, &multiline.Config{
+		Mode:         "newline",
+		Expression:   "^[^ ]",
+		IdleDuration: "1000s",
+	})
+
+	// simulate two blocks merging (e.g. one from Process's own Handle call, one from a concurrent idle
+	// flush) before any Process call drains the queue
+	_ = ms.Handle(model.LabelSet{"stream": "a"}, time.Now(), "block 1")
+	_ = ms.Handle(model.LabelSet{"stream": "b"}, time.Now(), "block 2")
+
+	labels := model.LabelSet{"stream": "c"}
+	extracted := map[string]interface{}{}
+	ts := time.Now()
+	entry := "unrelated line"
+
+	ms.Process(labels, extracted, &ts, &entry)
+	assert.Equal(t, "block 1", entry, "the oldest queued block is forwarded first, not dropped")
+
+	labels = model.LabelSet{"stream": "c"}
+	entry = "another unrelated line"
+	ms.Process(labels, extracted, &ts, &entry)
+	assert.Equal(t, "block 2", entry, "the second queued block is forwarded next, not lost")
+}
+
+// TestMultilineStageIdleFlushRequiresLaterProcessCall pins the documented limitation of this adapter: a
+// block closed by the parser's idle timer only reaches `m.pending`, it is not forwarded anywhere until some
+// later call to Process happens to come in. If no such call ever arrives (e.g. the stream goes idle for
+// good), the block is never delivered - see the multilineStage doc comment.
+func TestMultilineStageIdleFlushRequiresLaterProcessCall(t *testing.T) {
+	ms := newTestStage(t, &multiline.Config{
+		Mode:         "continue",
+		Expression:   `(.*)\\$`,
+		IdleDuration: "10ms",
+	})
+
+	labels := model.LabelSet{"stream": "a"}
+	extracted := map[string]interface{}{}
+	ts := time.Now()
+	entry := `event\`
+	ms.Process(labels, extracted, &ts, &entry)
+
+	// the parser's idle flusher ticks no more often than every 100ms, whatever IdleDuration is
+	time.Sleep(250 * time.Millisecond)
+
+	ms.mu.Lock()
+	pending := ms.pending
+	ms.mu.Unlock()
+	if assert.Len(t, pending, 1, "the idle timer should have closed the block into m.pending") {
+		assert.Equal(t, "event", pending[0].entry)
+	}
+
+	// nothing short of another Process call surfaces it: an unrelated line on the same stream does
+	labels = model.LabelSet{"stream": "a"}
+	entry = `unrelated\`
+	ms.Process(labels, extracted, &ts, &entry)
+	assert.Equal(t, "event", entry, "the idle-flushed block finally surfaces, one Process call late")
+}